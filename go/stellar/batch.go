@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,15 +16,115 @@ import (
 	"github.com/keybase/client/go/stellar/remote"
 	"github.com/keybase/client/go/stellar/stellarcommon"
 	"github.com/keybase/stellarnet"
+	"github.com/stellar/go/amount"
 	"github.com/stellar/go/build"
 )
 
 const minAmountRelayXLM = "2.01"
 const minAmountCreateAccountXLM = "1"
 
+// batch payment reasons let callers distinguish a payment that genuinely
+// failed to submit from one that was only affected by an earlier payment's
+// seqno gap.
+const (
+	batchPaymentReasonSkippedGap          = "skipped-due-to-gap"
+	batchPaymentReasonResignedResubmitted = "resigned-and-resubmitted"
+)
+
+// seqnoGapTracker reacts to a submission failure partway through a batch by
+// re-signing the remaining, not-yet-submitted payments with decremented
+// seqnos so they aren't rejected by the network as seqno-gapped. This is
+// modeled on the Lotus mpool technique of tracking an expected nonce and
+// patching messages that have fallen behind it.
+type seqnoGapTracker struct {
+	sync.Mutex
+	resigned map[int]bool
+	skipped  map[int]bool
+}
+
+func newSeqnoGapTracker() *seqnoGapTracker {
+	return &seqnoGapTracker{
+		resigned: make(map[int]bool),
+		skipped:  make(map[int]bool),
+	}
+}
+
+func (t *seqnoGapTracker) skip(i int) bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.skipped[i]
+}
+
+func (t *seqnoGapTracker) wasResigned(i int) bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.resigned[i]
+}
+
+// resignRemaining resets the seqno provider and re-signs every remaining
+// payment in place with a decremented seqno, without allocating a new
+// source keypair for the sender. The provider is reset atomically under
+// the tracker's mutex before any re-signing begins, so two submission
+// failures racing each other can't interleave their resigns.
+func (t *seqnoGapTracker) resignRemaining(mctx libkb.MetaContext, walletState *WalletState, senderSeed stellarnet.SeedStr, prepared []*MiniPrepared, from int) error {
+	t.Lock()
+	defer t.Unlock()
+
+	sp := NewSeqnoProvider(mctx, walletState)
+	for i := from; i < len(prepared); i++ {
+		mp := prepared[i]
+		if mp == nil || mp.Error != nil || t.skipped[i] {
+			continue
+		}
+		if mp.isDuplicate {
+			// duplicate-merge rows never carry a transaction of their own
+			// to re-sign; they just mirror the group's primary
+			continue
+		}
+		if mp.channelAccountID != "" {
+			// channel-sharded rows are sourced and sequenced off their own
+			// channel account, not the primary sender, so a gap on the
+			// primary account's submission path doesn't affect them; re-
+			// signing here would wrongly rebuild them as primary-sourced
+			// txs while leaving channelAccountID set, so they'd still get
+			// dispatched down the channel-submission path with a signed
+			// transaction that no longer matches it
+			continue
+		}
+		if err := mp.resign(mctx, sp, senderSeed); err != nil {
+			// this and every later payment in the batch can no longer be
+			// submitted in seqno order; mark them skipped rather than
+			// letting them fail against a seqno they'll never match
+			for j := i; j < len(prepared); j++ {
+				t.skipped[j] = true
+			}
+			return err
+		}
+		t.resigned[i] = true
+	}
+	return nil
+}
+
 // Batch sends a batch of payments from the user to multiple recipients in
 // a time-efficient manner.
 func Batch(mctx libkb.MetaContext, walletState *WalletState, arg stellar1.BatchLocalArg) (res stellar1.BatchResultLocal, err error) {
+	events := make(chan BatchEvent)
+	go func() {
+		// the blocking variant has nothing to forward events to; just drain
+		// them so runBatch never blocks trying to send one
+		for range events {
+		}
+	}()
+	defer close(events)
+
+	return runBatch(mctx, walletState, arg, events)
+}
+
+// runBatch is the shared implementation behind the blocking Batch and the
+// streaming BatchStream: it submits every payment and waits for the
+// results, pushing a BatchEvent to events at each step so a caller that
+// wants incremental progress can observe it while it's still running.
+func runBatch(mctx libkb.MetaContext, walletState *WalletState, arg stellar1.BatchLocalArg, events chan<- BatchEvent) (res stellar1.BatchResultLocal, err error) {
 	mctx = mctx.WithLogTag("BATCH=" + arg.BatchID)
 
 	startTime := time.Now()
@@ -44,13 +145,20 @@ func Batch(mctx libkb.MetaContext, walletState *WalletState, arg stellar1.BatchL
 	mctx.CDebugf("Batch size: %d", len(arg.Payments))
 
 	// prepare the payments
-	prepared, err := PrepareBatchPayments(mctx, walletState, senderSeed, arg.Payments)
+	prepared, err := PrepareBatchPayments(mctx, walletState, senderSeed, arg.Payments, arg.MergeDuplicateRecipients, arg.ChannelAccounts)
 	if err != nil {
 		return res, err
 	}
 
 	res.PreparedTime = stellar1.ToTimeMs(time.Now())
 
+	for i, mp := range prepared {
+		if mp == nil {
+			continue
+		}
+		events <- BatchEvent{Kind: BatchEventPrepared, Index: i, Payment: stellar1.BatchPaymentResult{Username: mp.Username.String()}}
+	}
+
 	// make a listener that will get payment status updates
 	listenerID, listenerCh, err := DefaultLoader(mctx.G()).GetListener()
 	if err != nil {
@@ -59,73 +167,141 @@ func Batch(mctx libkb.MetaContext, walletState *WalletState, arg stellar1.BatchL
 	defer DefaultLoader(mctx.G()).RemoveListener(listenerID)
 
 	resultList := make([]stellar1.BatchPaymentResult, len(prepared))
-	waiting := make(map[stellar1.TransactionID]int)
+	// waiting maps a TxID to every resultList index it should resolve when a
+	// status update for it arrives. Usually this is a single index, but a
+	// merged payment's TxID resolves every original row that was folded
+	// into it, and a fee-bumped payment's outer TxID takes over the
+	// indices its inner TxID resolved before the bump.
+	waiting := make(map[stellar1.TransactionID][]int)
+
+	// after a submission failure, re-sign the remaining txs against a fresh
+	// seqno provider so a single failure doesn't cascade into every later
+	// tx in the batch getting rejected for a seqno gap; the sender's seqno
+	// at batch start is not recorded
+	gapTracker := newSeqnoGapTracker()
 
 	// submit the payments
-	// need to submit tx one at a time, in order
+	// need to submit tx one at a time, in order, except for payments that
+	// were prepared against a channel account: those are submitted in
+	// parallel afterward, grouped by channel account, since each channel
+	// account has its own independent seqno
+	var waitingMu sync.Mutex
 	for i := 0; i < len(prepared); i++ {
 		if prepared[i] == nil {
 			// this should never happen
 			return res, errors.New("batch prepare failed")
 		}
+		if prepared[i].channelAccountID != "" {
+			continue
+		}
 
 		bpResult := stellar1.BatchPaymentResult{
 			Username:  prepared[i].Username.String(),
 			StartTime: stellar1.ToTimeMs(time.Now()),
 		}
-		if prepared[i].Error != nil {
+		switch {
+		case prepared[i].isDuplicate:
+			// this row was merged into an earlier payment to the same
+			// recipient; it was never given its own Stellar operation, so
+			// mirror whatever the primary row's result is so far
+			primary := resultList[prepared[i].duplicateOfIndex]
+			bpResult = primary
+			bpResult.Username = prepared[i].Username.String()
+			if primary.Status == stellar1.PaymentStatus_PENDING {
+				waiting[primary.TxID] = append(waiting[primary.TxID], i)
+			}
+		case prepared[i].Error != nil:
 			makeResultError(&bpResult, prepared[i].Error)
-		} else {
+		case gapTracker.skip(i):
+			bpResult.Reason = batchPaymentReasonSkippedGap
+			makeResultError(&bpResult, errors.New("skipped because an earlier payment in this batch failed to submit"))
+		default:
+			if gapTracker.wasResigned(i) {
+				bpResult.Reason = batchPaymentReasonResignedResubmitted
+			}
 			submitBatchTx(mctx, walletState, senderAccountID, prepared[i], &bpResult)
 			if bpResult.Status == stellar1.PaymentStatus_PENDING {
 				// add the tx id and the index of this payment to a waiting list
-				waiting[bpResult.TxID] = i
+				waiting[bpResult.TxID] = append(waiting[bpResult.TxID], i)
+			} else if bpResult.Status == stellar1.PaymentStatus_ERROR {
+				// the sender's seqno is now out of sync with what the
+				// network expects, so every remaining prepared tx would be
+				// rejected as seqno-gapped; re-sign them in place with
+				// decremented seqnos before continuing
+				if err := gapTracker.resignRemaining(mctx, walletState, senderSeed, prepared, i+1); err != nil {
+					mctx.CDebugf("unable to resign remaining batch payments after seqno gap: %s", err)
+				}
 			}
 		}
 
 		bpResult.StatusDescription = stellar1.PaymentStatusRevMap[bpResult.Status]
 		resultList[i] = bpResult
+		events <- BatchEvent{Kind: BatchEventSubmitted, Index: i, Payment: bpResult}
+	}
+
+	if shards := groupByChannelAccount(prepared); len(shards) > 0 {
+		submitBatchPaymentsSharded(mctx, walletState, senderSeed, shards, prepared, resultList, waiting, &waitingMu, events)
 	}
 
 	res.AllSubmittedTime = stellar1.ToTimeMs(time.Now())
 
 	// wait for the payments
-	waitingCount := len(waiting)
+	waitingCount := 0
+	for _, indices := range waiting {
+		waitingCount += len(indices)
+	}
 	mctx.CDebugf("waiting for %d payments to complete", waitingCount)
 
 	timedOut := false
+	listenerUpdateCount := int64(0)
+	tickInterval := 5 * time.Second
 	var chatWaitGroup sync.WaitGroup
 	for waitingCount > 0 && !timedOut {
 		select {
-		case <-time.After(5 * time.Second):
+		case <-time.After(tickInterval):
+			if pendingTimeoutRatio() > batchBackoffPendingTimeoutRatio {
+				tickInterval = 10 * time.Second
+				mctx.CDebugf("recent batches show a high pending-timeout rate, backing off submission checks to %s", tickInterval)
+			} else {
+				tickInterval = 5 * time.Second
+			}
+			if arg.BumpAfterSecs > 0 {
+				bumpStalePayments(mctx, walletState, senderAccountID, arg, prepared, resultList, waiting)
+			}
 			if time.Since(startTime) > time.Duration(arg.TimeoutSecs)*time.Second {
 				mctx.CDebugf("ran out of time waiting for tx status updates (%d remaining)", waitingCount)
 				timedOut = true
 			}
 		case update := <-listenerCh:
-			index, ok := waiting[update.TxID]
+			indices, ok := waiting[update.TxID]
 			if ok {
+				listenerUpdateCount++
 				mctx.CDebugf("received status update for %s: %s", update.TxID, update.Status)
-				resultList[index].Status = update.Status
-				resultList[index].StatusDescription = stellar1.PaymentStatusRevMap[update.Status]
+				for _, index := range indices {
+					resultList[index].Status = update.Status
+					resultList[index].StatusDescription = stellar1.PaymentStatusRevMap[update.Status]
+					if update.Status != stellar1.PaymentStatus_PENDING {
+						waitingCount--
+						resultList[index].EndTime = stellar1.ToTimeMs(time.Now())
+					}
+					if update.Status == stellar1.PaymentStatus_COMPLETED {
+						chatWaitGroup.Add(1)
+						go func(m libkb.MetaContext, recipient string, txID stellar1.TransactionID) {
+							if err := chatSendPaymentMessageTo(m, recipient, txID); err != nil {
+								m.CDebugf("chatSendPaymentMessageTo %s (%s): error: %s", recipient, txID, err)
+							} else {
+								m.CDebugf("chatSendPaymentMessageTo %s (%s): success", recipient, txID)
+							}
+
+							chatWaitGroup.Done()
+						}(mctx.WithCtx(context.Background()), resultList[index].Username, update.TxID)
+					}
+					events <- BatchEvent{Kind: BatchEventStatusUpdate, Index: index, Payment: resultList[index]}
+				}
 				if update.Status != stellar1.PaymentStatus_PENDING {
-					waitingCount--
-					resultList[index].EndTime = stellar1.ToTimeMs(time.Now())
 					delete(waiting, update.TxID)
 					mctx.CDebugf("no longer waiting for %s status updates (%d remaining)", update.TxID, waitingCount)
 				}
-				if update.Status == stellar1.PaymentStatus_COMPLETED {
-					chatWaitGroup.Add(1)
-					go func(m libkb.MetaContext, recipient string, txID stellar1.TransactionID) {
-						if err := chatSendPaymentMessageTo(m, recipient, txID); err != nil {
-							m.CDebugf("chatSendPaymentMessageTo %s (%s): error: %s", recipient, txID, err)
-						} else {
-							m.CDebugf("chatSendPaymentMessageTo %s (%s): success", recipient, txID)
-						}
-
-						chatWaitGroup.Done()
-					}(mctx.WithCtx(context.Background()), resultList[index].Username, update.TxID)
-				}
 			}
 		}
 	}
@@ -138,7 +314,10 @@ func Batch(mctx libkb.MetaContext, walletState *WalletState, arg stellar1.BatchL
 
 	res.Payments = resultList
 	res.EndTime = stellar1.ToTimeMs(time.Now())
-	calculateStats(&res)
+	calculateStats(&res, listenerUpdateCount)
+	recordBatchMetrics(&res)
+
+	events <- BatchEvent{Kind: BatchEventComplete, Result: &res}
 
 	return res, nil
 }
@@ -146,14 +325,40 @@ func Batch(mctx libkb.MetaContext, walletState *WalletState, arg stellar1.BatchL
 // PrepareBatchPayments prepares a list of payments to be submitted.
 // Each payment is prepared concurrently.
 // (this is an exposed function to make testing from outside this package easier)
-func PrepareBatchPayments(mctx libkb.MetaContext, walletState *WalletState, senderSeed stellarnet.SeedStr, payments []stellar1.BatchPaymentArg) ([]*MiniPrepared, error) {
+func PrepareBatchPayments(mctx libkb.MetaContext, walletState *WalletState, senderSeed stellarnet.SeedStr, payments []stellar1.BatchPaymentArg, mergeDuplicateRecipients bool, channelAccounts []ChannelAccount) ([]*MiniPrepared, error) {
 	mctx.CDebugf("preparing %d batch payments", len(payments))
 
-	prepared := make(chan *MiniPrepared)
+	if len(channelAccounts) > 0 {
+		if mergeDuplicateRecipients {
+			// merging and channel-account sharding don't compose yet: shard
+			// assignment happens on the original payment indices, so
+			// merging first would leave the shards with nothing to
+			// dispatch. Channel accounts win so callers asking for both
+			// still get parallelized submission, but every row is sent
+			// unmerged.
+			mctx.CDebugf("MergeDuplicateRecipients is ignored when ChannelAccounts is also set")
+		}
+		return prepareBatchPaymentsSharded(mctx, walletState, senderSeed, payments, channelAccounts)
+	}
 
 	sp := NewSeqnoProvider(mctx, walletState)
+
+	if mergeDuplicateRecipients {
+		return prepareMergedBatchPayments(mctx, walletState, sp, senderSeed, payments)
+	}
+
+	prepared := make(chan *MiniPrepared)
+	var sem chan struct{}
+	if limit := currentPrepareConcurrencyLimit(); limit > 0 {
+		mctx.CDebugf("recent batches show network strain, capping batch prepare fan-out at %d", limit)
+		sem = make(chan struct{}, limit)
+	}
 	for _, payment := range payments {
 		go func(p stellar1.BatchPaymentArg) {
+			if sem != nil {
+				sem <- struct{}{}
+				defer func() { <-sem }()
+			}
 			prepared <- prepareBatchPayment(mctx, walletState, sp, senderSeed, p)
 		}(payment)
 	}
@@ -184,8 +389,159 @@ func prepareBatchPayment(mctx libkb.MetaContext, remoter remote.Remoter, sp buil
 	return prepareBatchPaymentDirect(mctx, remoter, sp, senderSeed, payment, recipient)
 }
 
+// batchRecipientKey identifies a resolved recipient for merge-grouping
+// purposes. Relay and direct payments are always kept in separate groups
+// (even if they happen to share a key string) since their encryption keys
+// differ and they can't share one Stellar operation.
+type batchRecipientKey struct {
+	isRelay   bool
+	accountID string
+	assertion string
+}
+
+type resolvedBatchPayment struct {
+	payment stellar1.BatchPaymentArg
+	recip   stellarcommon.Recipient
+	err     error
+}
+
+// prepareMergedBatchPayments resolves every payment's recipient, groups
+// payments that resolve to the same recipient (direct payments grouped by
+// AccountID, relay payments grouped by assertion, and the two kinds never
+// mixed), and submits a single Stellar payment per group: amounts are
+// summed and messages concatenated. It returns one *MiniPrepared per
+// original input row; rows that were merged into an earlier row in the
+// same group share that row's outcome so callers see the same TxID and
+// status for every line that contributed to it.
+func prepareMergedBatchPayments(mctx libkb.MetaContext, remoter remote.Remoter, sp build.SequenceProvider, senderSeed stellarnet.SeedStr, payments []stellar1.BatchPaymentArg) ([]*MiniPrepared, error) {
+	type indexedResolve struct {
+		index int
+		r     resolvedBatchPayment
+	}
+
+	resolvedCh := make(chan indexedResolve)
+	for i, payment := range payments {
+		go func(i int, p stellar1.BatchPaymentArg) {
+			recip, err := LookupRecipient(mctx, stellarcommon.RecipientInput(p.Recipient), false /* isCLI for identify purposes */)
+			resolvedCh <- indexedResolve{index: i, r: resolvedBatchPayment{payment: p, recip: recip, err: err}}
+		}(i, payment)
+	}
+
+	resolved := make([]resolvedBatchPayment, len(payments))
+	for i := 0; i < len(payments); i++ {
+		item := <-resolvedCh
+		resolved[item.index] = item.r
+	}
+
+	// group original indices by recipient key, preserving first-seen order
+	// so groups (and therefore the seqnos handed out below) stay in the
+	// same order as the original payments
+	var groupOrder []batchRecipientKey
+	groups := make(map[batchRecipientKey][]int)
+	for i, r := range resolved {
+		key := batchRecipientKey{accountID: fmt.Sprintf("lookup-error-%d", i)}
+		if r.err == nil {
+			if r.recip.AccountID == nil {
+				key = batchRecipientKey{isRelay: true, assertion: string(r.recip.Input)}
+			} else {
+				key = batchRecipientKey{accountID: r.recip.AccountID.String()}
+			}
+		}
+		if _, ok := groups[key]; !ok {
+			groupOrder = append(groupOrder, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	preparedList := make([]*MiniPrepared, len(payments))
+	for _, key := range groupOrder {
+		indices := groups[key]
+		primary := indices[0]
+
+		if resolved[primary].err != nil {
+			preparedList[primary] = &MiniPrepared{
+				Username: libkb.NewNormalizedUsername(resolved[primary].payment.Recipient),
+				Error:    errors.New("error looking up recipient"),
+			}
+			continue
+		}
+
+		payment := resolved[primary].payment
+		if len(indices) > 1 {
+			merged, err := mergeBatchPayments(resolved, indices)
+			if err != nil {
+				preparedList[primary] = &MiniPrepared{
+					Username: libkb.NewNormalizedUsername(payment.Recipient),
+					Error:    fmt.Errorf("error merging duplicate recipient payments: %v", err),
+				}
+				for _, dupIdx := range indices[1:] {
+					preparedList[dupIdx] = &MiniPrepared{
+						Username:         libkb.NewNormalizedUsername(resolved[dupIdx].payment.Recipient),
+						isDuplicate:      true,
+						duplicateOfIndex: primary,
+					}
+				}
+				continue
+			}
+			payment = merged
+		}
+
+		var mp *MiniPrepared
+		if resolved[primary].recip.AccountID == nil {
+			mp = prepareBatchPaymentRelay(mctx, remoter, sp, senderSeed, payment, resolved[primary].recip)
+		} else {
+			mp = prepareBatchPaymentDirect(mctx, remoter, sp, senderSeed, payment, resolved[primary].recip)
+		}
+		preparedList[primary] = mp
+
+		for _, dupIdx := range indices[1:] {
+			preparedList[dupIdx] = &MiniPrepared{
+				Username:         libkb.NewNormalizedUsername(resolved[dupIdx].payment.Recipient),
+				isDuplicate:      true,
+				duplicateOfIndex: primary,
+			}
+		}
+	}
+
+	return preparedList, nil
+}
+
+// mergeBatchPayments combines every payment in indices into one
+// BatchPaymentArg, summing amounts and concatenating messages. The
+// returned arg's Recipient is taken from the first index in the group. A
+// single index is returned unchanged.
+func mergeBatchPayments(resolved []resolvedBatchPayment, indices []int) (stellar1.BatchPaymentArg, error) {
+	merged := resolved[indices[0]].payment
+	if len(indices) == 1 {
+		return merged, nil
+	}
+
+	var total int64
+	var messages []string
+	for _, i := range indices {
+		p := resolved[i].payment
+		stroops, err := amount.ParseInt64(p.Amount)
+		if err != nil {
+			return merged, fmt.Errorf("invalid amount %q: %v", p.Amount, err)
+		}
+		total += stroops
+		if len(p.Message) > 0 {
+			messages = append(messages, p.Message)
+		}
+	}
+
+	merged.Amount = amount.StringFromInt64(total)
+	merged.Message = strings.Join(messages, "; ")
+	return merged, nil
+}
+
 func prepareBatchPaymentDirect(mctx libkb.MetaContext, remoter remote.Remoter, sp build.SequenceProvider, senderSeed stellarnet.SeedStr, payment stellar1.BatchPaymentArg, recipient stellarcommon.Recipient) *MiniPrepared {
-	result := &MiniPrepared{Username: libkb.NewNormalizedUsername(payment.Recipient)}
+	result := &MiniPrepared{
+		Username:  libkb.NewNormalizedUsername(payment.Recipient),
+		payment:   payment,
+		recipient: recipient,
+		remoter:   remoter,
+	}
 	funded, err := isAccountFunded(mctx.Ctx(), remoter, stellar1.AccountID(recipient.AccountID.String()))
 	if err != nil {
 		result.Error = err
@@ -241,7 +597,12 @@ func prepareBatchPaymentDirect(mctx libkb.MetaContext, remoter remote.Remoter, s
 }
 
 func prepareBatchPaymentRelay(mctx libkb.MetaContext, remoter remote.Remoter, sp build.SequenceProvider, senderSeed stellarnet.SeedStr, payment stellar1.BatchPaymentArg, recipient stellarcommon.Recipient) *MiniPrepared {
-	result := &MiniPrepared{Username: libkb.NewNormalizedUsername(payment.Recipient)}
+	result := &MiniPrepared{
+		Username:  libkb.NewNormalizedUsername(payment.Recipient),
+		payment:   payment,
+		recipient: recipient,
+		remoter:   remoter,
+	}
 
 	if isAmountLessThanMin(payment.Amount, minAmountRelayXLM) {
 		result.Error = fmt.Errorf("you must send at least %s XLM to fund the account for %s", minAmountRelayXLM, payment.Recipient)
@@ -287,7 +648,45 @@ func prepareBatchPaymentRelay(mctx libkb.MetaContext, remoter remote.Remoter, sp
 	return result
 }
 
-func calculateStats(res *stellar1.BatchResultLocal) {
+// resign re-signs mp in place against sp, which has already been reset to
+// the seqno the network now expects. The sender's source keypair is never
+// reallocated, but the transaction is rebuilt from mp's original payment:
+// its seqno, signature and TxID change, and so does the encrypted note of
+// a direct payment or the relay account and box of a relay payment.
+func (mp *MiniPrepared) resign(mctx libkb.MetaContext, sp build.SequenceProvider, senderSeed stellarnet.SeedStr) error {
+	switch {
+	case mp.Direct != nil:
+		resigned := prepareBatchPaymentDirect(mctx, mp.remoter, sp, senderSeed, mp.payment, mp.recipient)
+		if resigned.Error != nil {
+			return resigned.Error
+		}
+		mp.Direct = resigned.Direct
+		mp.Seqno = resigned.Seqno
+		mp.TxID = resigned.TxID
+	case mp.Relay != nil:
+		resigned := prepareBatchPaymentRelay(mctx, mp.remoter, sp, senderSeed, mp.payment, mp.recipient)
+		if resigned.Error != nil {
+			return resigned.Error
+		}
+		mp.Relay = resigned.Relay
+		mp.Seqno = resigned.Seqno
+		mp.TxID = resigned.TxID
+	default:
+		return errors.New("batch payment has neither a direct nor a relay prepared transaction")
+	}
+	return nil
+}
+
+// signedTransaction returns the raw signed inner transaction for mp,
+// whichever of Direct or Relay it was prepared as.
+func (mp *MiniPrepared) signedTransaction() string {
+	if mp.Direct != nil {
+		return mp.Direct.SignedTransaction
+	}
+	return mp.Relay.SignedTransaction
+}
+
+func calculateStats(res *stellar1.BatchResultLocal, listenerUpdateCount int64) {
 	res.OverallDurationMs = res.EndTime - res.StartTime
 	res.PrepareDurationMs = res.PreparedTime - res.StartTime
 	res.SubmitDurationMs = res.AllSubmittedTime - res.PreparedTime
@@ -298,6 +697,16 @@ func calculateStats(res *stellar1.BatchResultLocal) {
 	var durationError stellar1.TimeMs
 	var countDone int64
 
+	res.HorizonErrorCounts = make(map[string]int64)
+
+	// prepare happens once for the whole batch rather than per payment, so
+	// it only ever contributes a single data point to the histogram;
+	// submit and confirm latency are tracked per payment, since each one
+	// submits and confirms independently.
+	res.PrepareLatencyHistogramSec = map[int64]int64{bucketSec(res.PrepareDurationMs): 1}
+	res.SubmitLatencyHistogramSec = make(map[int64]int64)
+	res.ConfirmLatencyHistogramSec = make(map[int64]int64)
+
 	for _, p := range res.Payments {
 		duration := p.EndTime - p.StartTime
 		durationTotal += duration
@@ -313,6 +722,15 @@ func calculateStats(res *stellar1.BatchResultLocal) {
 			countDone++
 			res.CountError++
 			durationError += duration
+			if p.Error != nil {
+				res.HorizonErrorCounts[classifyHorizonError(p.Error.Message)]++
+			}
+		}
+		if p.SubmittedTime > p.StartTime {
+			res.SubmitLatencyHistogramSec[bucketSec(p.SubmittedTime-p.StartTime)]++
+		}
+		if p.EndTime > p.SubmittedTime {
+			res.ConfirmLatencyHistogramSec[bucketSec(p.EndTime-p.SubmittedTime)]++
 		}
 	}
 
@@ -327,6 +745,14 @@ func calculateStats(res *stellar1.BatchResultLocal) {
 	if res.CountError > 0 {
 		res.AvgErrorDurationMs = stellar1.TimeMs(int64(durationError) / int64(res.CountError))
 	}
+
+	if res.SubmitDurationMs > 0 {
+		res.SubmitRateTxPerSec = float64(len(res.Payments)) / (float64(res.SubmitDurationMs) / 1000)
+	}
+
+	if res.WaitDurationMs > 0 {
+		res.ListenerUpdateRateTxPerSec = float64(listenerUpdateCount) / (float64(res.WaitDurationMs) / 1000)
+	}
 }
 
 func makeResultError(res *stellar1.BatchPaymentResult, err error) {
@@ -370,3 +796,69 @@ func submitBatchTx(mctx libkb.MetaContext, walletState *WalletState, senderAccou
 		bpResult.EndTime = stellar1.ToTimeMs(time.Now())
 	}
 }
+
+// bumpStalePayments looks for payments that are still PENDING after
+// arg.BumpAfterSecs and, for each one that hasn't already been bumped,
+// wraps its original signed transaction in a CAP-15 fee-bump transaction
+// at arg.MaxFeeStroops and submits it. The new outer TxID replaces the
+// original inner TxID in waiting (see registerFeeBump), so from then on
+// only a status update keyed on the outer TxID resolves that resultList
+// slot; an update keyed on the inner TxID is ignored.
+func bumpStalePayments(mctx libkb.MetaContext, walletState *WalletState, senderAccountID stellar1.AccountID, arg stellar1.BatchLocalArg, prepared []*MiniPrepared, resultList []stellar1.BatchPaymentResult, waiting map[stellar1.TransactionID][]int) {
+	now := time.Now()
+	for txID, indices := range waiting {
+		if len(indices) == 0 {
+			continue
+		}
+		primary := &resultList[indices[0]]
+		if primary.Status != stellar1.PaymentStatus_PENDING || primary.FeeBumps > 0 {
+			continue
+		}
+		submittedTime := time.Unix(0, int64(primary.SubmittedTime)*int64(time.Millisecond))
+		if now.Sub(submittedTime) < time.Duration(arg.BumpAfterSecs)*time.Second {
+			continue
+		}
+
+		mctx.CDebugf("batch payment %s still pending after %ds, submitting a fee-bump", txID, arg.BumpAfterSecs)
+		innerSigned := prepared[indices[0]].signedTransaction()
+		bumpRes, err := walletState.SubmitFeeBumpPayment(mctx.Ctx(), innerSigned, arg.MaxFeeStroops)
+		if err != nil {
+			mctx.CDebugf("error submitting fee-bump for %s: %s", txID, err)
+			continue
+		}
+
+		// the bumped tx keeps the inner tx's seqno and source account, so
+		// register it with the listener the same way submitBatchTx
+		// registers every other submission, against whichever account
+		// actually owns that seqno -- the primary sender, unless this
+		// payment was sourced off a channel account.
+		bumpAccountID := senderAccountID
+		if prepared[indices[0]].channelAccountID != "" {
+			bumpAccountID = prepared[indices[0]].channelAccountID
+		}
+		if err := walletState.AddPendingTx(mctx.Ctx(), bumpAccountID, bumpRes.StellarID, prepared[indices[0]].Seqno); err != nil {
+			// it's ok to keep going here
+			mctx.CDebugf("error calling AddPendingTx for fee-bump %s: %s", bumpRes.StellarID, err)
+		}
+
+		registerFeeBump(resultList, waiting, txID, bumpRes.StellarID, indices)
+	}
+}
+
+// registerFeeBump updates resultList and waiting so that a status update
+// keyed on bumpTxID resolves the same indices txID used to: every index's
+// TxID is switched to bumpTxID and its FeeBumps count incremented, and
+// txID's entry in waiting is dropped once bumpTxID's replaces it, so a
+// status update still in flight for the superseded inner tx can't
+// re-process the same indices a second time after the outer tx resolves
+// them.
+func registerFeeBump(resultList []stellar1.BatchPaymentResult, waiting map[stellar1.TransactionID][]int, txID, bumpTxID stellar1.TransactionID, indices []int) {
+	for _, index := range indices {
+		resultList[index].TxID = bumpTxID
+		resultList[index].FeeBumps++
+	}
+	if bumpTxID != txID {
+		delete(waiting, txID)
+	}
+	waiting[bumpTxID] = indices
+}
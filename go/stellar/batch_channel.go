@@ -0,0 +1,313 @@
+package stellar
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/client/go/protocol/stellar1"
+	"github.com/keybase/client/go/stellar/stellarcommon"
+	"github.com/keybase/stellarnet"
+	"github.com/stellar/go/build"
+)
+
+// minChannelAccountBalanceXLM is the balance below which a channel
+// account is topped up from the primary sender before its shard submits
+// its first tx, so a channel account never runs dry mid-batch and stalls
+// its whole shard.
+const minChannelAccountBalanceXLM = "5"
+
+// channelAccountTopUpXLM is how much a channel account is topped up by
+// when its balance falls below minChannelAccountBalanceXLM.
+const channelAccountTopUpXLM = "10"
+
+// ChannelAccount is one of a user's pre-provisioned, funded auxiliary
+// Stellar accounts used to parallelize batch submission. Stellar enforces
+// strict per-account sequence ordering, so a single sender account can
+// only ever have one tx in flight at a time; spreading a batch's txs
+// across several channel accounts (each with its own sequence number)
+// lets Batch submit many of them concurrently. A channel account pays the
+// tx fee and owns the sequence number, but the payment operation itself
+// still carries the real sender as its source, so funds move out of the
+// user's own account exactly as they would without channel accounts.
+type ChannelAccount struct {
+	AccountID stellar1.AccountID
+	Seed      stellarnet.SeedStr
+}
+
+// RegisterChannelAccount adds ch to the user's wallet as a channel
+// account available to future batches.
+func (w *WalletState) RegisterChannelAccount(mctx libkb.MetaContext, ch ChannelAccount) error {
+	return w.AddChannelAccount(mctx.Ctx(), ch.AccountID, ch.Seed)
+}
+
+// batchShard is one channel account's slice of a sharded batch: the
+// indices (into the batch's payment list) it's responsible for, prepared
+// and submitted with sp, a SeqnoProvider bound to that channel account.
+type batchShard struct {
+	channel ChannelAccount
+	sp      build.SequenceProvider
+	indices []int
+}
+
+// shardBatchPayments splits indices round-robin across channelAccounts,
+// giving each shard its own SeqnoProvider bound to its channel account so
+// shards never contend over a single sequence number.
+func shardBatchPayments(mctx libkb.MetaContext, walletState *WalletState, channelAccounts []ChannelAccount, indices []int) []*batchShard {
+	shards := make([]*batchShard, len(channelAccounts))
+	for i, ch := range channelAccounts {
+		shards[i] = &batchShard{
+			channel: ch,
+			sp:      NewSeqnoProviderForAccount(mctx, walletState, ch.AccountID),
+		}
+	}
+	for i, idx := range indices {
+		shard := shards[i%len(shards)]
+		shard.indices = append(shard.indices, idx)
+	}
+	return shards
+}
+
+// prepareBatchPaymentsSharded resolves every payment's recipient and
+// shards the direct ones across channelAccounts, preparing each shard
+// concurrently. Relay payments and recipient lookup failures always stay
+// on the primary sender account, since the relay protocol's escrow setup
+// already has its own funding and signing flow that channel accounts
+// don't help with.
+func prepareBatchPaymentsSharded(mctx libkb.MetaContext, walletState *WalletState, senderSeed stellarnet.SeedStr, payments []stellar1.BatchPaymentArg, channelAccounts []ChannelAccount) ([]*MiniPrepared, error) {
+	type indexedRecipient struct {
+		index int
+		recip stellarcommon.Recipient
+		err   error
+	}
+
+	recipCh := make(chan indexedRecipient)
+	for i, payment := range payments {
+		go func(i int, p stellar1.BatchPaymentArg) {
+			recip, err := LookupRecipient(mctx, stellarcommon.RecipientInput(p.Recipient), false /* isCLI for identify purposes */)
+			recipCh <- indexedRecipient{index: i, recip: recip, err: err}
+		}(i, payment)
+	}
+
+	recipients := make([]stellarcommon.Recipient, len(payments))
+	recipErrs := make([]error, len(payments))
+	for i := 0; i < len(payments); i++ {
+		item := <-recipCh
+		recipients[item.index] = item.recip
+		recipErrs[item.index] = item.err
+	}
+
+	preparedList := make([]*MiniPrepared, len(payments))
+	relaySp := NewSeqnoProvider(mctx, walletState)
+
+	var directIndices []int
+	for i, payment := range payments {
+		switch {
+		case recipErrs[i] != nil:
+			mctx.CDebugf("LookupRecipient error: %s", recipErrs[i])
+			preparedList[i] = &MiniPrepared{
+				Username: libkb.NewNormalizedUsername(payment.Recipient),
+				Error:    errors.New("error looking up recipient"),
+			}
+		case recipients[i].AccountID == nil:
+			preparedList[i] = prepareBatchPaymentRelay(mctx, walletState, relaySp, senderSeed, payment, recipients[i])
+		default:
+			directIndices = append(directIndices, i)
+		}
+	}
+
+	shards := shardBatchPayments(mctx, walletState, channelAccounts, directIndices)
+	var wg sync.WaitGroup
+	for _, shard := range shards {
+		wg.Add(1)
+		go func(shard *batchShard) {
+			defer wg.Done()
+			for _, i := range shard.indices {
+				preparedList[i] = prepareBatchPaymentDirectViaChannel(mctx, walletState, shard.sp, senderSeed, shard.channel, payments[i], recipients[i])
+			}
+		}(shard)
+	}
+	wg.Wait()
+
+	return preparedList, nil
+}
+
+// prepareBatchPaymentDirectViaChannel is prepareBatchPaymentDirect's
+// channel-account counterpart: the tx source (and sp's account) is the
+// channel account, but the payment operation itself still debits the real
+// sender, so the channel account never needs its own balance beyond the
+// fee.
+func prepareBatchPaymentDirectViaChannel(mctx libkb.MetaContext, walletState *WalletState, sp build.SequenceProvider, senderSeed stellarnet.SeedStr, channel ChannelAccount, payment stellar1.BatchPaymentArg, recipient stellarcommon.Recipient) *MiniPrepared {
+	result := &MiniPrepared{
+		Username:         libkb.NewNormalizedUsername(payment.Recipient),
+		payment:          payment,
+		recipient:        recipient,
+		remoter:          walletState,
+		channelAccountID: channel.AccountID,
+	}
+
+	funded, err := isAccountFunded(mctx.Ctx(), walletState, stellar1.AccountID(recipient.AccountID.String()))
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	if !funded && isAmountLessThanMin(payment.Amount, minAmountCreateAccountXLM) {
+		result.Error = fmt.Errorf("you must send at least %s XLM to fund the account for %s", minAmountCreateAccountXLM, payment.Recipient)
+		return result
+	}
+
+	result.Direct = &stellar1.PaymentDirectPost{
+		FromDeviceID: mctx.G().ActiveDevice.DeviceID(),
+		To:           &recipient.User.UV,
+		QuickReturn:  true,
+	}
+
+	signResult, err := stellarnet.PaymentXLMTransactionViaChannel(channel.Seed, senderSeed, *recipient.AccountID, payment.Amount, "", sp, nil)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+
+	if len(payment.Message) > 0 {
+		noteClear := stellar1.NoteContents{
+			Note:      payment.Message,
+			StellarID: stellar1.TransactionID(signResult.TxHash),
+		}
+		var recipientUv *keybase1.UserVersion
+		if recipient.User != nil {
+			recipientUv = &recipient.User.UV
+		}
+		result.Direct.NoteB64, err = NoteEncryptB64(mctx, noteClear, recipientUv)
+		if err != nil {
+			result.Error = fmt.Errorf("error encrypting note: %v", err)
+			return result
+		}
+	}
+
+	result.Direct.SignedTransaction = signResult.Signed
+	result.Seqno = signResult.Seqno
+	result.TxID = stellar1.TransactionID(signResult.TxHash)
+
+	return result
+}
+
+// ensureChannelAccountFunded tops ch up from the primary sender if its
+// balance has fallen below minChannelAccountBalanceXLM. sp is shared
+// across every shard's top-up so two shards topping up in the same window
+// can't be handed the same next seqno for the primary account; callers
+// must run this sequentially (never from two goroutines at once) for that
+// sharing to be safe.
+func ensureChannelAccountFunded(mctx libkb.MetaContext, walletState *WalletState, senderSeed stellarnet.SeedStr, sp build.SequenceProvider, ch ChannelAccount) error {
+	balance, err := walletState.ChannelAccountBalanceXLM(mctx.Ctx(), ch.AccountID)
+	if err != nil {
+		return err
+	}
+	if !isAmountLessThanMin(balance, minChannelAccountBalanceXLM) {
+		return nil
+	}
+
+	mctx.CDebugf("topping up channel account %s (balance %s XLM)", ch.AccountID, balance)
+	signResult, err := stellarnet.PaymentXLMTransaction(senderSeed, stellarnet.AddressStr(ch.AccountID), channelAccountTopUpXLM, "", sp, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = walletState.SubmitPayment(mctx.Ctx(), stellar1.PaymentDirectPost{
+		FromDeviceID:      mctx.G().ActiveDevice.DeviceID(),
+		SignedTransaction: signResult.Signed,
+		QuickReturn:       true,
+	})
+	return err
+}
+
+// fundChannelAccountsIfNeeded tops up every shard's channel account that
+// needs it, one at a time, sharing a single SeqnoProvider for the primary
+// account across all of them. Top-ups must not run concurrently with each
+// other: two independent SeqnoProviders racing for the primary account's
+// next seqno would hand out the same value twice, and Stellar would reject
+// one of the resulting transactions as a bad seqno.
+func fundChannelAccountsIfNeeded(mctx libkb.MetaContext, walletState *WalletState, senderSeed stellarnet.SeedStr, shards []*batchShard) {
+	sp := NewSeqnoProvider(mctx, walletState)
+	for _, shard := range shards {
+		if err := ensureChannelAccountFunded(mctx, walletState, senderSeed, sp, shard.channel); err != nil {
+			mctx.CDebugf("channel account %s top-up failed, shard will submit anyway: %s", shard.channel.AccountID, err)
+		}
+	}
+}
+
+// groupByChannelAccount collects every prepared index that was sharded
+// onto a channel account (see prepareBatchPaymentDirectViaChannel), keyed
+// by which channel account it's on.
+func groupByChannelAccount(prepared []*MiniPrepared) []*batchShard {
+	byAccount := make(map[stellar1.AccountID]*batchShard)
+	var order []stellar1.AccountID
+	for i, mp := range prepared {
+		if mp == nil || mp.channelAccountID == "" {
+			continue
+		}
+		shard, ok := byAccount[mp.channelAccountID]
+		if !ok {
+			shard = &batchShard{channel: ChannelAccount{AccountID: mp.channelAccountID}}
+			byAccount[mp.channelAccountID] = shard
+			order = append(order, mp.channelAccountID)
+		}
+		shard.indices = append(shard.indices, i)
+	}
+
+	shards := make([]*batchShard, len(order))
+	for i, accountID := range order {
+		shards[i] = byAccount[accountID]
+	}
+	return shards
+}
+
+// submitBatchPaymentsSharded submits every channel-account shard in
+// parallel: different shards run concurrently since each has an
+// independent channel account and seqno, but within a shard, payments are
+// still submitted one at a time, in order, same as the primary account's
+// submission loop. Waiting-map updates are written under waitingMu so
+// shards can't race each other on it; each shard writes only its own
+// indices of resultList, without the lock. runBatch calls this after the
+// primary account's sequential submission loop has finished.
+func submitBatchPaymentsSharded(mctx libkb.MetaContext, walletState *WalletState, senderSeed stellarnet.SeedStr, shards []*batchShard, prepared []*MiniPrepared, resultList []stellar1.BatchPaymentResult, waiting map[stellar1.TransactionID][]int, waitingMu *sync.Mutex, events chan<- BatchEvent) {
+	fundChannelAccountsIfNeeded(mctx, walletState, senderSeed, shards)
+
+	var wg sync.WaitGroup
+	for _, shard := range shards {
+		wg.Add(1)
+		go func(shard *batchShard) {
+			defer wg.Done()
+
+			for _, i := range shard.indices {
+				bpResult := stellar1.BatchPaymentResult{
+					Username:  prepared[i].Username.String(),
+					StartTime: stellar1.ToTimeMs(time.Now()),
+				}
+				if prepared[i].Error != nil {
+					makeResultError(&bpResult, prepared[i].Error)
+				} else {
+					// prepared[i] is sourced and sequenced off this shard's
+					// channel account, not the primary sender, so its
+					// pending-tx bookkeeping needs to be registered against
+					// the channel account -- registering it against
+					// the primary sender would corrupt the primary's own
+					// pending-seqno tracking and leave the channel account's
+					// seqno untracked.
+					submitBatchTx(mctx, walletState, shard.channel.AccountID, prepared[i], &bpResult)
+					if bpResult.Status == stellar1.PaymentStatus_PENDING {
+						waitingMu.Lock()
+						waiting[bpResult.TxID] = append(waiting[bpResult.TxID], i)
+						waitingMu.Unlock()
+					}
+				}
+				bpResult.StatusDescription = stellar1.PaymentStatusRevMap[bpResult.Status]
+				resultList[i] = bpResult
+				events <- BatchEvent{Kind: BatchEventSubmitted, Index: i, Payment: bpResult}
+			}
+		}(shard)
+	}
+	wg.Wait()
+}
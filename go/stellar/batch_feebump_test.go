@@ -0,0 +1,57 @@
+package stellar
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/protocol/stellar1"
+)
+
+// TestRegisterFeeBumpResolvesListenerUpdateForOuterTxID guards against a
+// regression where a fee-bumped payment's waiting entry was only ever
+// registered under its superseded inner TxID, so a listener update for the
+// new outer TxID -- the only one the batch ever actually submitted for
+// listening -- could never resolve resultList, leaving the payment stuck
+// at PENDING until the whole batch timed out.
+func TestRegisterFeeBumpResolvesListenerUpdateForOuterTxID(t *testing.T) {
+	innerTxID := stellar1.TransactionID("inner-tx")
+	outerTxID := stellar1.TransactionID("outer-bumped-tx")
+	indices := []int{2, 5}
+
+	resultList := make([]stellar1.BatchPaymentResult, 6)
+	for _, i := range indices {
+		resultList[i] = stellar1.BatchPaymentResult{TxID: innerTxID, Status: stellar1.PaymentStatus_PENDING}
+	}
+	waiting := map[stellar1.TransactionID][]int{innerTxID: indices}
+
+	registerFeeBump(resultList, waiting, innerTxID, outerTxID, indices)
+
+	if _, stillWaitingOnInner := waiting[innerTxID]; stillWaitingOnInner {
+		t.Errorf("waiting still has an entry for the superseded inner TxID %s; a late status update for it would re-process %v a second time", innerTxID, indices)
+	}
+
+	resolvedIndices, ok := waiting[outerTxID]
+	if !ok {
+		t.Fatalf("waiting has no entry for the bumped outer TxID %s; a listener update for it could never resolve the payment", outerTxID)
+	}
+	if len(resolvedIndices) != len(indices) {
+		t.Fatalf("waiting[outerTxID] = %v, want %v", resolvedIndices, indices)
+	}
+
+	// simulate the listener delivering a terminal status update keyed on
+	// the outer TxID, the same way runBatch's wait loop would
+	for _, index := range resolvedIndices {
+		resultList[index].Status = stellar1.PaymentStatus_COMPLETED
+	}
+
+	for _, i := range indices {
+		if resultList[i].TxID != outerTxID {
+			t.Errorf("resultList[%d].TxID = %s, want %s", i, resultList[i].TxID, outerTxID)
+		}
+		if resultList[i].FeeBumps != 1 {
+			t.Errorf("resultList[%d].FeeBumps = %d, want 1", i, resultList[i].FeeBumps)
+		}
+		if resultList[i].Status != stellar1.PaymentStatus_COMPLETED {
+			t.Errorf("resultList[%d].Status = %v, want COMPLETED after the simulated listener update", i, resultList[i].Status)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package stellar
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+)
+
+// TestResignRemainingSkipsDuplicateAndChannelRows guards against a
+// regression where resignRemaining would hand a merged-duplicate or
+// channel-sharded row to mp.resign: a duplicate row has no transaction of
+// its own to re-sign, so mp.resign errors out and marks every later index
+// in the batch skipped even though they were perfectly resignable, and a
+// channel row would be rebuilt as a primary-sourced tx.
+func TestResignRemainingSkipsDuplicateAndChannelRows(t *testing.T) {
+	tc := libkb.SetupTest(t, "stellar", 1)
+	defer tc.Cleanup()
+	mctx := libkb.NewMetaContextForTest(tc)
+
+	prepared := []*MiniPrepared{
+		{isDuplicate: true, duplicateOfIndex: 0},
+		{channelAccountID: "GCHANNELACCOUNT"},
+		{isDuplicate: true, duplicateOfIndex: 0},
+	}
+
+	tracker := newSeqnoGapTracker()
+	err := tracker.resignRemaining(mctx, &WalletState{}, "", prepared, 0)
+	if err != nil {
+		t.Fatalf("resignRemaining should skip duplicate/channel rows rather than error, got: %s", err)
+	}
+
+	for i := range prepared {
+		if tracker.skip(i) {
+			t.Errorf("index %d should not be marked skipped: duplicate/channel rows are excluded from gap recovery entirely, not skipped by it", i)
+		}
+		if tracker.wasResigned(i) {
+			t.Errorf("index %d should not be marked resigned: it was never a candidate for resigning", i)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package stellar
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/protocol/stellar1"
+	"github.com/stellar/go/amount"
+)
+
+func TestMergeBatchPaymentsSumsAmountsAndJoinsMessages(t *testing.T) {
+	resolved := []resolvedBatchPayment{
+		{payment: stellar1.BatchPaymentArg{Recipient: "alice", Amount: "1.5", Message: "first"}},
+		{payment: stellar1.BatchPaymentArg{Recipient: "alice", Amount: "2.25", Message: "second"}},
+		{payment: stellar1.BatchPaymentArg{Recipient: "alice", Amount: "0.25"}},
+	}
+
+	merged, err := mergeBatchPayments(resolved, []int{0, 1, 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	wantTotal, err := amount.ParseInt64("4")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	gotTotal, err := amount.ParseInt64(merged.Amount)
+	if err != nil {
+		t.Fatalf("merged.Amount %q did not parse: %s", merged.Amount, err)
+	}
+	if gotTotal != wantTotal {
+		t.Errorf("merged.Amount = %s (%d stroops), want 4 (%d stroops)", merged.Amount, gotTotal, wantTotal)
+	}
+
+	wantMessage := "first; second"
+	if merged.Message != wantMessage {
+		t.Errorf("merged.Message = %q, want %q", merged.Message, wantMessage)
+	}
+
+	if merged.Recipient != "alice" {
+		t.Errorf("merged.Recipient = %q, want the group's first recipient %q", merged.Recipient, "alice")
+	}
+}
+
+func TestMergeBatchPaymentsRejectsUnparsableAmount(t *testing.T) {
+	resolved := []resolvedBatchPayment{
+		{payment: stellar1.BatchPaymentArg{Recipient: "alice", Amount: "1"}},
+		{payment: stellar1.BatchPaymentArg{Recipient: "alice", Amount: "not-a-number"}},
+	}
+
+	if _, err := mergeBatchPayments(resolved, []int{0, 1}); err == nil {
+		t.Fatal("expected an error for an unparsable amount, got nil")
+	}
+}
+
+func TestMergeBatchPaymentsSingleIndexIsIdentity(t *testing.T) {
+	resolved := []resolvedBatchPayment{
+		{payment: stellar1.BatchPaymentArg{Recipient: "alice", Amount: "3", Message: "only"}},
+	}
+
+	merged, err := mergeBatchPayments(resolved, []int{0})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if merged.Amount != "3" || merged.Message != "only" {
+		t.Errorf("merging a single index changed the payment: got %+v", merged)
+	}
+}
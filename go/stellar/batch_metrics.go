@@ -0,0 +1,151 @@
+package stellar
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/keybase/client/go/protocol/stellar1"
+)
+
+// Horizon error kinds recognized in a BatchPaymentError's message, used to
+// bucket res.HorizonErrorCounts in calculateStats. These mirror the
+// submission-result strings horizon returns for the failure modes a batch
+// is most likely to hit: a stale sequence number, a tx that expired before
+// it was included, or a fee too low to be accepted.
+const (
+	horizonErrorBadSeq          = "bad_seq"
+	horizonErrorTxTooLate       = "tx_too_late"
+	horizonErrorInsufficientFee = "insufficient_fee"
+	horizonErrorOther           = "other"
+)
+
+// bucketSec buckets a TimeMs duration into the 1-second bucket it falls
+// into, for the prepare/submit/confirm latency histograms.
+func bucketSec(d stellar1.TimeMs) int64 {
+	return int64(d) / 1000
+}
+
+// classifyHorizonError buckets a BatchPaymentError's message into one of
+// the horizonError* kinds, for aggregation in BatchMetrics.
+func classifyHorizonError(msg string) string {
+	switch {
+	case strings.Contains(msg, horizonErrorBadSeq):
+		return horizonErrorBadSeq
+	case strings.Contains(msg, horizonErrorTxTooLate):
+		return horizonErrorTxTooLate
+	case strings.Contains(msg, horizonErrorInsufficientFee):
+		return horizonErrorInsufficientFee
+	default:
+		return horizonErrorOther
+	}
+}
+
+// batchMetricsWindowSize is N in the M-of-N sliding window BatchMetrics
+// aggregates over: only the most recent batchMetricsWindowSize completed
+// batches contribute to the live metrics used for adaptive throttling.
+const batchMetricsWindowSize = 20
+
+// batchBackoffPendingTimeoutRatio is the fraction of payments across the
+// recent window that have to still be PENDING at batch-complete time
+// before Batch's wait loop backs off and checks for status updates less
+// often.
+const batchBackoffPendingTimeoutRatio = 0.3
+
+// batchThrottledPrepareConcurrency is the fan-out cap PrepareBatchPayments
+// applies once the recent window shows the network is struggling: it still
+// starts one goroutine per payment, but no more than this many prepare at
+// once. The cap applies only when payments are neither merged nor sharded
+// across channel accounts.
+const batchThrottledPrepareConcurrency = 10
+
+var (
+	batchMetricsMu     sync.Mutex
+	batchMetricsWindow []stellar1.BatchResultLocal
+)
+
+// recordBatchMetrics adds res to the sliding window BatchMetrics
+// aggregates over, evicting the oldest entry once the window is full.
+func recordBatchMetrics(res *stellar1.BatchResultLocal) {
+	batchMetricsMu.Lock()
+	defer batchMetricsMu.Unlock()
+
+	batchMetricsWindow = append(batchMetricsWindow, *res)
+	if len(batchMetricsWindow) > batchMetricsWindowSize {
+		batchMetricsWindow = batchMetricsWindow[len(batchMetricsWindow)-batchMetricsWindowSize:]
+	}
+}
+
+// BatchMetrics aggregates throughput and error stats across the recent
+// window of completed batches, so UI/CLI can render live batch health
+// without an additional round trip per batch.
+func BatchMetrics() stellar1.BatchStatsLocal {
+	batchMetricsMu.Lock()
+	defer batchMetricsMu.Unlock()
+
+	var stats stellar1.BatchStatsLocal
+	stats.ErrorCounts = make(map[string]int64)
+	stats.PrepareLatencyHistogramSec = make(map[int64]int64)
+	stats.SubmitLatencyHistogramSec = make(map[int64]int64)
+	stats.ConfirmLatencyHistogramSec = make(map[int64]int64)
+
+	if len(batchMetricsWindow) == 0 {
+		return stats
+	}
+
+	var submitRateTotal, listenerRateTotal float64
+	for _, res := range batchMetricsWindow {
+		stats.PaymentCount += int64(len(res.Payments))
+		stats.PendingTimeoutCount += res.CountPending
+		submitRateTotal += res.SubmitRateTxPerSec
+		listenerRateTotal += res.ListenerUpdateRateTxPerSec
+		for kind, count := range res.HorizonErrorCounts {
+			stats.ErrorCounts[kind] += count
+		}
+		for bucket, count := range res.PrepareLatencyHistogramSec {
+			stats.PrepareLatencyHistogramSec[bucket] += count
+		}
+		for bucket, count := range res.SubmitLatencyHistogramSec {
+			stats.SubmitLatencyHistogramSec[bucket] += count
+		}
+		for bucket, count := range res.ConfirmLatencyHistogramSec {
+			stats.ConfirmLatencyHistogramSec[bucket] += count
+		}
+	}
+
+	n := float64(len(batchMetricsWindow))
+	stats.BatchCount = int64(len(batchMetricsWindow))
+	stats.AvgSubmitRateTxPerSec = submitRateTotal / n
+	stats.AvgListenerUpdateRateTxPerSec = listenerRateTotal / n
+
+	return stats
+}
+
+// pendingTimeoutRatio is the fraction of payments across the recent window
+// that were still PENDING when their batch completed. Batch's wait loop
+// uses this to decide whether to back off checking for status updates as
+// often.
+func pendingTimeoutRatio() float64 {
+	batchMetricsMu.Lock()
+	defer batchMetricsMu.Unlock()
+
+	var paymentCount, pendingCount int64
+	for _, res := range batchMetricsWindow {
+		paymentCount += int64(len(res.Payments))
+		pendingCount += res.CountPending
+	}
+	if paymentCount == 0 {
+		return 0
+	}
+	return float64(pendingCount) / float64(paymentCount)
+}
+
+// currentPrepareConcurrencyLimit returns the fan-out cap
+// PrepareBatchPayments should apply to its per-payment goroutines: 0 means
+// unlimited, the default while the network looks healthy or there isn't
+// yet enough history to judge it.
+func currentPrepareConcurrencyLimit() int {
+	if pendingTimeoutRatio() > batchBackoffPendingTimeoutRatio {
+		return batchThrottledPrepareConcurrency
+	}
+	return 0
+}
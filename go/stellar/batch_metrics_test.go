@@ -0,0 +1,78 @@
+package stellar
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/protocol/stellar1"
+)
+
+func TestCalculateStatsLatencyHistogramsAndErrorCounts(t *testing.T) {
+	res := &stellar1.BatchResultLocal{
+		StartTime:        0,
+		PreparedTime:     2500,
+		AllSubmittedTime: 2500,
+		EndTime:          9500,
+		Payments: []stellar1.BatchPaymentResult{
+			{
+				StartTime:     2500,
+				SubmittedTime: 3500, // 1s submit latency
+				EndTime:       5500, // 2s confirm latency
+				Status:        stellar1.PaymentStatus_COMPLETED,
+			},
+			{
+				StartTime:     2500,
+				SubmittedTime: 4500, // 2s submit latency
+				EndTime:       4500, // still pending, no confirm latency yet
+				Status:        stellar1.PaymentStatus_PENDING,
+			},
+			{
+				StartTime:     2500,
+				SubmittedTime: 3500, // 1s submit latency
+				EndTime:       3500, // error has no further confirm wait
+				Status:        stellar1.PaymentStatus_ERROR,
+				Error:         &stellar1.BatchPaymentError{Message: "op_bad_seq"},
+			},
+		},
+	}
+
+	calculateStats(res, 0 /* listenerUpdateCount */)
+
+	if got := res.PrepareLatencyHistogramSec[2]; got != 1 {
+		t.Errorf("PrepareLatencyHistogramSec[2] = %d, want 1 (one batch-wide 2.5s prepare bucketed to 2s)", got)
+	}
+
+	if got := res.SubmitLatencyHistogramSec[1]; got != 2 {
+		t.Errorf("SubmitLatencyHistogramSec[1] = %d, want 2", got)
+	}
+	if got := res.SubmitLatencyHistogramSec[2]; got != 1 {
+		t.Errorf("SubmitLatencyHistogramSec[2] = %d, want 1", got)
+	}
+
+	if got := res.ConfirmLatencyHistogramSec[2]; got != 1 {
+		t.Errorf("ConfirmLatencyHistogramSec[2] = %d, want 1", got)
+	}
+	if total := len(res.ConfirmLatencyHistogramSec); total != 1 {
+		t.Errorf("ConfirmLatencyHistogramSec has %d buckets, want 1 (the still-pending and errored payments shouldn't contribute)", total)
+	}
+
+	if got := res.HorizonErrorCounts[horizonErrorBadSeq]; got != 1 {
+		t.Errorf("HorizonErrorCounts[%s] = %d, want 1", horizonErrorBadSeq, got)
+	}
+}
+
+func TestBucketSec(t *testing.T) {
+	cases := []struct {
+		ms   stellar1.TimeMs
+		want int64
+	}{
+		{0, 0},
+		{999, 0},
+		{1000, 1},
+		{2500, 2},
+	}
+	for _, c := range cases {
+		if got := bucketSec(c.ms); got != c.want {
+			t.Errorf("bucketSec(%d) = %d, want %d", c.ms, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package stellar
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/stellar1"
+)
+
+// batchSubscriptionRetention is how long a completed batch's subscription
+// is kept around so a client that disconnected right before completion can
+// still BatchResume and see the final events, before it's evicted.
+const batchSubscriptionRetention = 5 * time.Minute
+
+// BatchEventKind identifies what changed about a batch in progress.
+type BatchEventKind int
+
+const (
+	BatchEventPrepared BatchEventKind = iota
+	BatchEventSubmitted
+	BatchEventStatusUpdate
+	BatchEventComplete
+)
+
+// BatchEvent is one increment of progress from a running batch: either a
+// single payment being prepared, submitted, or updated by the listener, or
+// the final "batch complete" event carrying the aggregate stats that
+// calculateStats produces. A BatchEventComplete event can also signal that
+// the batch never got that far: if Err is set, runBatch returned early
+// (e.g. it failed to look up the sender or to prepare the payments) and
+// Result is left nil.
+type BatchEvent struct {
+	Kind    BatchEventKind
+	Index   int
+	Payment stellar1.BatchPaymentResult
+	Result  *stellar1.BatchResultLocal // only set when Kind == BatchEventComplete
+	Err     error                      // only set when Kind == BatchEventComplete and the batch failed early
+}
+
+// batchSubscription fans a single running batch's events out to every
+// subscriber (the initial BatchStream caller plus any BatchResume callers
+// that reconnect later), buffering every event it has ever seen so a late
+// subscriber can replay history before receiving live events.
+type batchSubscription struct {
+	subscriptionID string
+
+	mu       sync.Mutex
+	buffered []BatchEvent
+	fanout   []chan BatchEvent
+	complete bool
+}
+
+func (s *batchSubscription) publish(ev BatchEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buffered = append(s.buffered, ev)
+	if ev.Kind == BatchEventComplete {
+		s.complete = true
+	}
+	for _, ch := range s.fanout {
+		sendOrEvictOldest(ch, ev)
+	}
+	if s.complete {
+		for _, ch := range s.fanout {
+			close(ch)
+		}
+		s.fanout = nil
+
+		subscriptionID := s.subscriptionID
+		time.AfterFunc(batchSubscriptionRetention, func() {
+			batchSubscriptions.Delete(subscriptionID)
+		})
+	}
+}
+
+// sendOrEvictOldest delivers ev to ch without ever blocking: if ch's
+// buffer is full (a subscriber that isn't draining its stream), the oldest
+// buffered event is dropped to make room rather than stalling the
+// publisher. publish is called directly off runBatch's events channel, so
+// blocking here would stall real payment submission for the whole batch
+// behind one slow subscriber -- the same failure mode Batch's own drain
+// goroutine exists to avoid.
+func sendOrEvictOldest(ch chan BatchEvent, ev BatchEvent) {
+	for {
+		select {
+		case ch <- ev:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+			return
+		}
+	}
+}
+
+// subscribe returns a channel that first replays every buffered event and
+// then, unless the batch has already completed, continues to receive live
+// events as they're published.
+func (s *batchSubscription) subscribe() <-chan BatchEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := make(chan BatchEvent, len(s.buffered)+16)
+	for _, ev := range s.buffered {
+		ch <- ev
+	}
+	if s.complete {
+		close(ch)
+	} else {
+		s.fanout = append(s.fanout, ch)
+	}
+	return ch
+}
+
+var batchSubscriptions sync.Map // subscriptionID (string) -> *batchSubscription
+
+// BatchStream runs arg as a batch the same way Batch does, except instead
+// of blocking until every payment is done it returns immediately with a
+// subscription ID and a channel of BatchEvent deltas: one event when a
+// payment is prepared, one when it's submitted, one for each listener
+// status change, and a final BatchEventComplete event with the aggregate
+// stats that Batch would have returned.
+func BatchStream(mctx libkb.MetaContext, walletState *WalletState, arg stellar1.BatchLocalArg) (subscriptionID string, events <-chan BatchEvent, err error) {
+	subscriptionID, err = newBatchSubscriptionID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	sub := &batchSubscription{subscriptionID: subscriptionID}
+	batchSubscriptions.Store(subscriptionID, sub)
+
+	internalEvents := make(chan BatchEvent)
+	go func() {
+		for ev := range internalEvents {
+			sub.publish(ev)
+		}
+	}()
+
+	go func() {
+		defer close(internalEvents)
+		if _, err := runBatch(mctx, walletState, arg, internalEvents); err != nil {
+			mctx.CDebugf("BatchStream %s: runBatch error: %s", subscriptionID, err)
+			// runBatch can fail before it ever reaches the point where it
+			// would send its own BatchEventComplete (e.g. it couldn't look
+			// up the sender or prepare the payments). Without a terminal
+			// event here, sub never marks itself complete, so every
+			// subscriber -- this call's and any later BatchResume's --
+			// would hang forever on a batch that already failed.
+			internalEvents <- BatchEvent{Kind: BatchEventComplete, Err: err}
+		}
+	}()
+
+	return subscriptionID, sub.subscribe(), nil
+}
+
+// BatchResume reconnects to a batch subscription that was returned by an
+// earlier BatchStream call, for a client that disconnected mid-batch. It
+// replays every event published so far before resuming live delivery, so
+// the caller doesn't miss anything that happened while it was away.
+func BatchResume(mctx libkb.MetaContext, subscriptionID string) (<-chan BatchEvent, error) {
+	v, ok := batchSubscriptions.Load(subscriptionID)
+	if !ok {
+		return nil, fmt.Errorf("no such batch subscription: %s", subscriptionID)
+	}
+	return v.(*batchSubscription).subscribe(), nil
+}
+
+func newBatchSubscriptionID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,101 @@
+package stellar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBatchSubscriptionReplaysBufferedEventsToNewSubscriber(t *testing.T) {
+	sub := &batchSubscription{subscriptionID: "test"}
+
+	sub.publish(BatchEvent{Kind: BatchEventPrepared, Index: 0})
+	sub.publish(BatchEvent{Kind: BatchEventSubmitted, Index: 0})
+
+	ch := sub.subscribe()
+
+	for i, wantKind := range []BatchEventKind{BatchEventPrepared, BatchEventSubmitted} {
+		select {
+		case ev := <-ch:
+			if ev.Kind != wantKind {
+				t.Errorf("event %d: Kind = %v, want %v", i, ev.Kind, wantKind)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d: timed out waiting for replayed event", i)
+		}
+	}
+}
+
+func TestBatchSubscriptionCompletionClosesFanout(t *testing.T) {
+	sub := &batchSubscription{subscriptionID: "test"}
+	ch := sub.subscribe()
+
+	sub.publish(BatchEvent{Kind: BatchEventComplete})
+
+	select {
+	case ev, ok := <-ch:
+		if !ok {
+			t.Fatal("channel closed before delivering the BatchEventComplete event")
+		}
+		if ev.Kind != BatchEventComplete {
+			t.Errorf("Kind = %v, want BatchEventComplete", ev.Kind)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the complete event")
+	}
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("expected channel to be closed after BatchEventComplete")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for channel to close")
+	}
+
+	// a subscriber that arrives after completion should get a pre-closed
+	// channel, after replaying the buffered history
+	late := sub.subscribe()
+	select {
+	case ev, ok := <-late:
+		if !ok {
+			t.Fatal("late subscriber's channel closed before replaying the buffered complete event")
+		}
+		if ev.Kind != BatchEventComplete {
+			t.Errorf("late subscriber: Kind = %v, want BatchEventComplete", ev.Kind)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for late subscriber's replayed event")
+	}
+	if _, ok := <-late; ok {
+		t.Fatal("expected late subscriber's channel to be closed after replay")
+	}
+}
+
+func TestSendOrEvictOldestDropsOldestRatherThanBlocking(t *testing.T) {
+	ch := make(chan BatchEvent, 2)
+	sendOrEvictOldest(ch, BatchEvent{Index: 1})
+	sendOrEvictOldest(ch, BatchEvent{Index: 2})
+
+	done := make(chan struct{})
+	go func() {
+		// with the channel already full, this must evict index 1 rather
+		// than block forever
+		sendOrEvictOldest(ch, BatchEvent{Index: 3})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sendOrEvictOldest blocked instead of evicting the oldest buffered event")
+	}
+
+	var got []int
+	for len(ch) > 0 {
+		got = append(got, (<-ch).Index)
+	}
+	want := []int{2, 3}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("channel contents = %v, want %v (oldest evicted, newest kept)", got, want)
+	}
+}